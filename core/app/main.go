@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"regexp"
@@ -15,10 +16,59 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 )
 
+// decayIncrLuaSrc is shared between decayIncrScript (single-request path,
+// cached server-side by SHA after the first call) and the pipelined batch
+// ingest path, which sends it with EVAL on every call since a pipeline can't
+// react to a NOSCRIPT reply mid-exec to retry with EVALSHA.
+const decayIncrLuaSrc = `
+local raw = redis.call('HGET', KEYS[1], ARGV[1])
+local count = 0
+local last = tonumber(ARGV[2])
+if raw then
+	local sep = string.find(raw, "|")
+	if sep then
+		count = tonumber(string.sub(raw, 1, sep - 1)) or 0
+		last = tonumber(string.sub(raw, sep + 1)) or last
+	end
+end
+local now = tonumber(ARGV[2])
+local lambda = tonumber(ARGV[3])
+local decayed = count * math.exp(-lambda * (now - last)) + 1
+redis.call('HSET', KEYS[1], ARGV[1], string.format("%.6f|%d", decayed, now))
+return tostring(decayed)
+`
+
+// banditIncrLuaSrc atomically applies one hit/miss observation to the
+// "hits|misses" value stored at a bandit hash field. Shared between
+// banditIncrScript (single-request path, cached server-side by SHA) and the
+// pipelined batch ingest path, which sends it with EVAL on every call for the
+// same reason decayIncrLuaSrc does: a pipeline can't react to a NOSCRIPT
+// reply mid-exec to retry with EVALSHA.
+const banditIncrLuaSrc = `
+local raw = redis.call('HGET', KEYS[1], ARGV[1])
+local hits = 0
+local misses = 0
+if raw then
+	local sep = string.find(raw, "|")
+	if sep then
+		hits = tonumber(string.sub(raw, 1, sep - 1)) or 0
+		misses = tonumber(string.sub(raw, sep + 1)) or 0
+	end
+end
+if ARGV[2] == "1" then
+	hits = hits + 1
+else
+	misses = misses + 1
+end
+redis.call('HSET', KEYS[1], ARGV[1], string.format("%.6f|%.6f", hits, misses))
+return "OK"
+`
+
 var (
 	ctx = context.Background()
 
@@ -46,15 +96,98 @@ var (
 	minProb       = getenvFloat("MIN_PROB", 0.01)
 	dropSelfLoops = getenvBool("DROP_SELF_LOOPS", true)
 
+	// Higher-order (n-gram) Markov context
+	markovOrder   = getenvInt("MARKOV_ORDER", 3)
+	minNgramCount = getenvInt("MIN_NGRAM_COUNT", 3)
+	sessTTL       = time.Duration(getenvInt("SESS_TTL_SECONDS", 1800)) * time.Second
+
+	// Time-decayed transition counts
+	decayHalfLife        = time.Duration(getenvInt("DECAY_HALF_LIFE", 7*24*3600)) * time.Second
+	decayLambda          = math.Ln2 / decayHalfLife.Seconds()
+	minDecayedCount      = getenvFloat("MIN_DECAYED_COUNT", 0.5)
+	decayCompactInterval = time.Duration(getenvInt("DECAY_COMPACT_INTERVAL_SECONDS", 3600)) * time.Second
+
+	// decayIncrScript atomically reads "count|last_ts" for a hash field,
+	// applies exponential decay up to now, adds 1, and stores it back.
+	decayIncrScript = redis.NewScript(decayIncrLuaSrc)
+
+	// banditIncrScript atomically applies one hit/miss observation to a
+	// bandit hash field, avoiding the read-modify-write race a plain
+	// HGET+HSET would have under concurrent ingests for the same edge.
+	banditIncrScript = redis.NewScript(banditIncrLuaSrc)
+
 	// =========================
 	// Path normalization
 	// =========================
-	reUUID = regexp.MustCompile(`/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[1-5][0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}(/|$)`)
-    reInt  = regexp.MustCompile(`/\d+(/|$)`)
+	reUUID      = regexp.MustCompile(`/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[1-5][0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}(/|$)`)
+	reInt       = regexp.MustCompile(`/\d+(/|$)`)
 	reUUIDToken = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[1-5][0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}`)
 	reIntToken  = regexp.MustCompile(`(?:^|/)\d+(?:/|$)`)
+
+	// =========================
+	// Batch endpoints
+	// =========================
+	policyBatchSizeHist = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anticip8_policy_batch_size",
+		Help:    "Number of requests in a single POST /policy/next_batch call.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	ingestBatchSizeHist = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anticip8_ingest_batch_size",
+		Help:    "Number of events in a single POST /ingest/events call.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	redisPipelineLatencyHist = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "anticip8_redis_pipeline_latency_seconds",
+		Help:    "Latency of a single Redis pipeline Exec used by the batch endpoints.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	policyRequestFanoutHist = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anticip8_policy_request_fanout",
+		Help:    "Redis commands issued per individual request within a policy batch.",
+		Buckets: prometheus.LinearBuckets(1, 1, 10),
+	})
+
+	// =========================
+	// Policy mode / bandit
+	// =========================
+	// policyMode selects how computePolicy ranks/reorders candidates:
+	// hybrid (default), markov_only, i2v_only, epsilon_greedy, thompson.
+	policyMode           = getenv("POLICY_MODE", "hybrid")
+	epsilonGreedyEpsilon = getenvFloat("EPSILON_GREEDY_EPSILON", 0.1)
+	banditPriorAlpha     = getenvFloat("BANDIT_PRIOR_ALPHA", 1.0)
+	banditPriorBeta      = getenvFloat("BANDIT_PRIOR_BETA", 1.0)
+
+	// Online evaluation
+	lastRecTTL = time.Duration(getenvInt("LAST_REC_TTL_SECONDS", 1800)) * time.Second
+	evalHitK   = getenvInt("EVAL_HIT_K", 3)
+
+	// =========================
+	// Online evaluation metrics
+	// =========================
+	evalEvaluatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anticip8_eval_evaluated_total",
+		Help: "Ingested events for which a prior cached recommendation existed and was scored.",
+	}, []string{"source"})
+	evalHitAtOneTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anticip8_eval_hit_at_one_total",
+		Help: "Events where the actual next path matched the top-ranked recommendation.",
+	}, []string{"source"})
+	evalHitAtKTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anticip8_eval_hit_at_k_total",
+		Help: "Events where the actual next path matched any of the top EVAL_HIT_K recommendations.",
+	}, []string{"source"})
+	evalReciprocalRankSum = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anticip8_eval_reciprocal_rank_sum",
+		Help: "Sum of 1/rank for matched recommendations, for computing MRR by subsystem.",
+	}, []string{"source"})
 )
 
+func init() {
+	prometheus.MustRegister(policyBatchSizeHist, ingestBatchSizeHist, redisPipelineLatencyHist, policyRequestFanoutHist)
+	prometheus.MustRegister(evalEvaluatedTotal, evalHitAtOneTotal, evalHitAtKTotal, evalReciprocalRankSum)
+}
+
 type Event struct {
 	Service   string `json:"service"`
 	UserKey   string `json:"user_key"`
@@ -88,6 +221,10 @@ type NextPath struct {
 	Service string  `json:"service"`
 	Path    string  `json:"path"`
 	Score   float64 `json:"score"`
+	// Source names the subsystem that contributed this candidate's winning
+	// score (ngram, markov, markov_cross, prefetch, or i2v), used to
+	// attribute online evaluation metrics to a subsystem.
+	Source string `json:"source,omitempty"`
 }
 
 type PolicyResp struct {
@@ -96,6 +233,23 @@ type PolicyResp struct {
 	MaxPrefetchTimeMS int        `json:"max_prefetch_time_ms"`
 }
 
+type PolicyBatchItem struct {
+	Service string `json:"service"`
+	Path    string `json:"path"`
+	UserKey string `json:"user_key"`
+	Limit   int    `json:"limit"`
+}
+
+// IngestBatchItem is one entry of POST /ingest/events. Kind selects which of
+// the embedded payloads is populated ("event", "edge", or "prefetch"); the
+// other fields are ignored.
+type IngestBatchItem struct {
+	Kind     string           `json:"kind"`
+	Event    *Event           `json:"event,omitempty"`
+	Edge     *EdgeEvent       `json:"edge,omitempty"`
+	Prefetch *PrefetchAttempt `json:"prefetch,omitempty"`
+}
+
 // Item2Vec payload: [{ "item": "svc::/path", "cos": 0.93 }, ...]
 type i2vItem struct {
 	Item string  `json:"item"`
@@ -110,6 +264,8 @@ func main() {
 	}
 	rdb = redis.NewClient(opt)
 
+	go runDecayCompactor(decayCompactInterval)
+
 	r := gin.New()
 	r.Use(gin.Recovery())
 
@@ -132,8 +288,10 @@ func main() {
 			return
 		}
 
+		evaluateIngestEvent(ev.Service, f, ev.UserKey, ev.Service, t)
+
 		// HINCRBY trans:{service}:{from} to 1
-		if err := rdb.HIncrBy(ctx, kTrans(ev.Service, f), t, 1).Err(); err != nil {
+		if err := decayIncr(kTrans(ev.Service, f), t); err != nil {
 			c.JSON(500, gin.H{"ok": false, "error": err.Error()})
 			return
 		}
@@ -142,6 +300,33 @@ func main() {
 			c.JSON(500, gin.H{"ok": false, "error": err.Error()})
 			return
 		}
+
+		// higher-order (n-gram) transitions: trans_n:{service}:{p_{t-2}|p_{t-1}} -> p_t
+		if markovOrder >= 3 {
+			sessKey := kSess(ev.UserKey)
+			hist, err := rdb.LRange(ctx, sessKey, 0, int64(markovOrder-3)).Result()
+			if err != nil {
+				hist = nil
+			}
+			// newest-first: f, then progressively older paths
+			recent := append([]string{f}, hist...)
+			for order := markovOrder; order >= 3; order-- {
+				need := order - 1
+				if len(recent) < need {
+					continue
+				}
+				parts := make([]string, need)
+				for i := 0; i < need; i++ {
+					parts[i] = recent[need-1-i]
+				}
+				ngramCtx := strings.Join(parts, "|")
+				rdb.HIncrBy(ctx, kTransN(ev.Service, ngramCtx), t, 1)
+			}
+			rdb.LPush(ctx, sessKey, f)
+			rdb.LTrim(ctx, sessKey, 0, int64(markovOrder-2))
+			rdb.Expire(ctx, sessKey, sessTTL)
+		}
+
 		c.JSON(200, gin.H{"ok": true})
 	})
 
@@ -161,8 +346,10 @@ func main() {
 			return
 		}
 
+		evaluateIngestEvent(ev.SrcService, src, ev.UserKey, ev.DstService, dst)
+
 		packed := pack(ev.DstService, dst)
-		if err := rdb.HIncrBy(ctx, kTransAny(ev.SrcService, src), packed, 1).Err(); err != nil {
+		if err := decayIncr(kTransAny(ev.SrcService, src), packed); err != nil {
 			c.JSON(500, gin.H{"ok": false, "error": err.Error()})
 			return
 		}
@@ -190,55 +377,352 @@ func main() {
 		}
 
 		packed := pack(ev.DstService, dst)
-		if err := rdb.HIncrBy(ctx, kTransPrefetch(ev.SrcService, src), packed, 1).Err(); err != nil {
+		if err := decayIncr(kTransPrefetch(ev.SrcService, src), packed); err != nil {
 			c.JSON(500, gin.H{"ok": false, "error": err.Error()})
 			return
 		}
-		if err := rdb.HIncrBy(ctx, kTotalPrefetch(ev.SrcService), src, 1).Err(); err != nil {
+		// kTotalPrefetch decays on the same basis as kTransPrefetch so the
+		// allowPrefetchAttemptsInPolicy ratio doesn't drift toward zero as a
+		// plain, never-decaying denominator would under long-lived traffic.
+		if err := decayIncr(kTotalPrefetch(ev.SrcService), src); err != nil {
 			c.JSON(500, gin.H{"ok": false, "error": err.Error()})
 			return
 		}
 		c.JSON(200, gin.H{"ok": true})
 	})
 
+	// POST /ingest/events: same per-kind handling as /ingest/event|edge|prefetch,
+	// but coalesces every HINCRBY/EVAL/session-buffer update for the whole batch
+	// into two pipelined Redis round trips instead of one round trip per event.
+	r.POST("/ingest/events", func(c *gin.Context) {
+		var items []IngestBatchItem
+		if err := c.ShouldBindJSON(&items); err != nil {
+			c.JSON(400, gin.H{"ok": false, "error": err.Error()})
+			return
+		}
+		ingestBatchSizeHist.Observe(float64(len(items)))
+
+		runIngestBatch(items)
+
+		c.JSON(200, gin.H{"ok": true, "count": len(items)})
+	})
+
 	// -------------------------
 	// Policy
 	// -------------------------
 	r.GET("/policy/next", func(c *gin.Context) {
-	service := c.Query("service")
-	rawPath := c.Query("path")
+		service := c.Query("service")
+		rawPath := c.Query("path")
 
-	limit := getenvInt("POLICY_LIMIT_DEFAULT", 3)
-	if q := c.Query("limit"); q != "" {
-		if v, err := strconv.Atoi(q); err == nil {
-			limit = v
+		limit := getenvInt("POLICY_LIMIT_DEFAULT", 3)
+		if q := c.Query("limit"); q != "" {
+			if v, err := strconv.Atoi(q); err == nil {
+				limit = v
+			}
+		}
+		if limit < 0 {
+			limit = 0
+		}
+		if service == "" || rawPath == "" {
+			c.JSON(400, gin.H{"error": "service and path required"})
+			return
 		}
+
+		p := normPath(rawPath)
+		if isNoise(p) {
+			c.JSON(200, PolicyResp{NextPaths: []NextPath{}, MaxPrefetch: 0, MaxPrefetchTimeMS: 0})
+			return
+		}
+
+		var ngramTrans map[string]string
+		if markovOrder >= 3 {
+			hist, err := rdb.LRange(ctx, kSess(userKeyFromRequest(c)), 0, int64(markovOrder-3)).Result()
+			if err != nil {
+				hist = nil
+			}
+			ngramTrans = backOffNgram(service, p, hist)
+		}
+
+		trans, _ := rdb.HGetAll(ctx, kTrans(service, p)).Result()
+		trans2, _ := rdb.HGetAll(ctx, kTransAny(service, p)).Result()
+
+		var totalpStr string
+		var trans2p map[string]string
+		if allowPrefetchAttemptsInPolicy {
+			totalpStr, _ = rdb.HGet(ctx, kTotalPrefetch(service), p).Result()
+			trans2p, _ = rdb.HGetAll(ctx, kTransPrefetch(service, p)).Result()
+		}
+
+		i2vRaw, _ := rdb.Get(ctx, i2vKey(service, p)).Result()
+
+		resp := computePolicy(policyInputs{
+			service:    service,
+			rawPath:    rawPath,
+			p:          p,
+			limit:      limit,
+			nowUnix:    time.Now().Unix(),
+			ngramTrans: ngramTrans,
+			trans:      trans,
+			trans2:     trans2,
+			totalpStr:  totalpStr,
+			trans2p:    trans2p,
+			i2vRaw:     i2vRaw,
+		})
+
+		cacheLastRecommendation(service, p, userKeyFromRequest(c), resp.NextPaths)
+
+		c.JSON(200, resp)
+	})
+
+	// POST /policy/next_batch: same scoring as /policy/next, but coalesces all
+	// Redis reads for the whole batch into a couple of pipelined round trips
+	// instead of 3-5 sequential round trips per request.
+	r.POST("/policy/next_batch", func(c *gin.Context) {
+		var items []PolicyBatchItem
+		if err := c.ShouldBindJSON(&items); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		policyBatchSizeHist.Observe(float64(len(items)))
+
+		out := make([]PolicyResp, len(items))
+		runPolicyBatch(items, out)
+
+		c.JSON(200, out)
+	})
+	// -------------------------
+	// Debug + misc
+	// -------------------------
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	r.GET("/debug/policy_raw", func(c *gin.Context) {
+		service := c.Query("service")
+		path := c.Query("path")
+		if service == "" || path == "" {
+			c.JSON(400, gin.H{"error": "service and path required"})
+			return
+		}
+		p := normPath(path)
+
+		trans, _ := rdb.HGetAll(ctx, kTrans(service, p)).Result()
+		trans2, _ := rdb.HGetAll(ctx, kTransAny(service, p)).Result()
+
+		nowUnix := time.Now().Unix()
+		topTrans := topNDecayedHash(trans, nowUnix, 10)
+		topTrans2 := topNDecayedHash(trans2, nowUnix, 10)
+
+		c.JSON(200, gin.H{
+			"p":           p,
+			"trans_keys":  len(trans),
+			"trans2_keys": len(trans2),
+			"top_trans":   topTrans,
+			"top_trans2":  topTrans2,
+			"i2v":         getI2VCandidates(service, p)[:minInt(10, len(getI2VCandidates(service, p)))],
+		})
+	})
+
+	// Prometheus metrics endpoint (you already scrape /metrics)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	port := getenv("PORT", "8000")
+	srv := &http.Server{
+		Addr:              "0.0.0.0:" + port,
+		Handler:           r,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	log.Printf("core-go up on :%s redis=%s", port, redisURL)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// =========================
+// Helpers
+// =========================
+
+func normPath(p string) string {
+	if p == "" {
+		return p
 	}
-	if limit < 0 {
-		limit = 0
+	if isNoise(p) {
+		return p
 	}
-	if service == "" || rawPath == "" {
-		c.JSON(400, gin.H{"error": "service and path required"})
-		return
+	if p != "/" && strings.HasSuffix(p, "/") {
+		p = strings.TrimSuffix(p, "/")
+	}
+	p = reUUID.ReplaceAllString(p, "/{uuid}$1")
+	p = reInt.ReplaceAllString(p, "/{id}$1")
+	return p
+}
+
+func isNoise(p string) bool {
+	for _, pref := range noisePrefixes {
+		if strings.HasPrefix(p, pref) {
+			return true
+		}
 	}
+	return false
+}
 
-	// normalized node key
-	p := normPath(rawPath)
-	if isNoise(p) {
-		c.JSON(200, PolicyResp{NextPaths: []NextPath{}, MaxPrefetch: 0, MaxPrefetchTimeMS: 0})
-		return
+func i2vKey(service, path string) string {
+	return i2vPrefix + service + "::" + path
+}
+
+func parseNode(node string) (string, string, bool) {
+	parts := strings.SplitN(node, "::", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func getI2VCandidates(service, path string) []NextPath {
+	raw, err := rdb.Get(ctx, i2vKey(service, path)).Result()
+	if err != nil || raw == "" {
+		return nil
+	}
+	return parseI2VCandidates(raw)
+}
+
+func parseI2VCandidates(raw string) []NextPath {
+	if raw == "" {
+		return nil
+	}
+	var data []i2vItem
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return nil
 	}
+	out := make([]NextPath, 0, minInt(i2vTopK, len(data)))
+	for i := 0; i < len(data) && i < i2vTopK; i++ {
+		n := data[i].Item
+		if n == "" {
+			continue
+		}
+		svc, p, ok := parseNode(n)
+		if !ok {
+			continue
+		}
+		out = append(out, NextPath{Service: svc, Path: p, Score: data[i].Cos})
+	}
+	return out
+}
+
+// Redis keys
+func kTrans(service, fromPath string) string       { return "trans:" + service + ":" + fromPath }
+func kTotal(service string) string                 { return "tot:" + service }
+func kTransAny(srcService, fromPath string) string { return "trans2:" + srcService + ":" + fromPath }
+func kTotalAny(service string) string              { return "tot2:" + service }
+func kTransPrefetch(srcService, fromPath string) string {
+	return "ptrans:" + srcService + ":" + fromPath
+}
+func kTotalPrefetch(service string) string { return "ptot:" + service }
+func kSess(userKey string) string          { return "sess:" + userKey }
+func kTransN(service, ngramCtx string) string {
+	return "trans_n:" + service + ":" + ngramCtx
+}
+func kLastRec(service, fromPath, userKey string) string {
+	return "lastrec:" + service + ":" + fromPath + ":" + userKey
+}
+
+// kBandit is a hash of packedDst -> "hits|misses", one per (service, fromPath)
+// edge source, mirroring the trans:/trans2: hash-per-source layout.
+func kBandit(service, fromPath string) string {
+	return "bandit:" + service + ":" + fromPath
+}
+
+// ngramContextKeys returns the trans_n context keys to try, ordered from the
+// configured markovOrder down to order 3, given the most recent path p and
+// the user's session history (newest-first, as returned by LRange on kSess).
+// Orders for which there isn't enough history yet are skipped.
+func ngramContextKeys(p string, hist []string, maxOrder int) []string {
+	recent := append([]string{p}, hist...)
+	keys := make([]string, 0, maxOrder-2)
+	for order := maxOrder; order >= 3; order-- {
+		need := order - 1
+		if len(recent) < need {
+			continue
+		}
+		parts := make([]string, need)
+		for i := 0; i < need; i++ {
+			parts[i] = recent[need-1-i]
+		}
+		keys = append(keys, strings.Join(parts, "|"))
+	}
+	return keys
+}
+
+// selectNgramHash picks the first hash (highest order first) whose total
+// count clears minNgramCount, implementing the back-off to shorter orders.
+func selectNgramHash(hashes []map[string]string) map[string]string {
+	for _, h := range hashes {
+		if len(h) == 0 {
+			continue
+		}
+		var total int64
+		for _, cntStr := range h {
+			cn, err := strconv.ParseInt(cntStr, 10, 64)
+			if err == nil && cn > 0 {
+				total += cn
+			}
+		}
+		if total >= int64(minNgramCount) {
+			return h
+		}
+	}
+	return nil
+}
+
+// backOffNgram looks up trans_n hashes for service/p one order at a time
+// (markovOrder down to 3) and returns the first one with enough counts.
+func backOffNgram(service, p string, hist []string) map[string]string {
+	keys := ngramContextKeys(p, hist, markovOrder)
+	hashes := make([]map[string]string, 0, len(keys))
+	for _, k := range keys {
+		h, err := rdb.HGetAll(ctx, kTransN(service, k)).Result()
+		if err != nil {
+			h = nil
+		}
+		hashes = append(hashes, h)
+	}
+	return selectNgramHash(hashes)
+}
+
+// policyInputs holds everything computePolicy needs to score one /policy/next
+// request, already fetched from Redis — by the single-request handler doing
+// its own sequential reads, or by runPolicyBatch doing them pipelined.
+type policyInputs struct {
+	service    string
+	rawPath    string
+	p          string
+	limit      int
+	nowUnix    int64
+	ngramTrans map[string]string
+	trans      map[string]string
+	trans2     map[string]string
+	totalpStr  string
+	trans2p    map[string]string
+	i2vRaw     string
+}
+
+// computePolicy holds the hybrid scoring logic shared by /policy/next and
+// /policy/next_batch: blend n-gram, pair-Markov, cross-service and i2v
+// candidates into a single ranked list of next paths.
+func computePolicy(in policyInputs) PolicyResp {
+	service, p, rawPath, limit := in.service, in.p, in.rawPath, in.limit
 
-	// detect tokens from *source* path
 	srcHasID := reIntToken.MatchString(rawPath) || strings.Contains(p, "{id}")
 	srcHasUUID := reUUIDToken.MatchString(rawPath) || strings.Contains(p, "{uuid}")
 
-	// collected probs for candidates: packed "svc|path" -> prob
 	markov := make(map[string]float64)
-
-	// helper: apply (smoothed) multinomial counts into markov map
-	applyCounts := func(counts map[string]int64) {
-		var total int64
+	// source records which subsystem actually supplied each candidate's
+	// retained (max) probability in markov, so hit@k/MRR attribution lines
+	// up with the score that won rather than whichever subsystem happened
+	// to touch the candidate first.
+	source := make(map[string]string)
+
+	applyCounts := func(label string, counts map[string]float64) {
+		var total float64
 		for _, v := range counts {
 			total += v
 		}
@@ -246,12 +730,12 @@ func main() {
 			return
 		}
 		k := float64(len(counts))
-		den := float64(total)
+		den := total
 		if markovSmooth > 0 && k > 0 {
 			den += markovSmooth * k
 		}
 		for key, cn := range counts {
-			num := float64(cn)
+			num := cn
 			if markovSmooth > 0 {
 				num += markovSmooth
 			}
@@ -261,14 +745,15 @@ func main() {
 			}
 			if cur, ok := markov[key]; !ok || prob > cur {
 				markov[key] = prob
+				source[key] = label
 			}
 		}
 	}
 
-	// 1) intra-service
-	if trans, err := rdb.HGetAll(ctx, kTrans(service, p)).Result(); err == nil && len(trans) > 0 {
-		counts := make(map[string]int64)
-		for to, cntStr := range trans {
+	// 0) higher-order (n-gram) context, already resolved via back-off
+	if len(in.ngramTrans) > 0 {
+		counts := make(map[string]float64)
+		for to, cntStr := range in.ngramTrans {
 			cn, err := strconv.ParseInt(cntStr, 10, 64)
 			if err != nil || cn <= 0 {
 				continue
@@ -276,19 +761,37 @@ func main() {
 			if dropSelfLoops && to == p {
 				continue
 			}
+			counts[pack(service, to)] = float64(cn)
+		}
+		if len(counts) > 0 {
+			applyCounts("ngram", counts)
+		}
+	}
+
+	// 1) intra-service
+	if len(in.trans) > 0 {
+		counts := make(map[string]float64)
+		for to, raw := range in.trans {
+			cn := parseDecayed(raw, in.nowUnix)
+			if cn <= 0 {
+				continue
+			}
+			if dropSelfLoops && to == p {
+				continue
+			}
 			counts[pack(service, to)] = cn
 		}
 		if len(counts) > 0 {
-			applyCounts(counts)
+			applyCounts("markov", counts)
 		}
 	}
 
 	// 2) cross-service REAL
-	if trans2, err := rdb.HGetAll(ctx, kTransAny(service, p)).Result(); err == nil && len(trans2) > 0 {
-		counts := make(map[string]int64)
-		for packed, cntStr := range trans2 {
-			cn, err := strconv.ParseInt(cntStr, 10, 64)
-			if err != nil || cn <= 0 {
+	if len(in.trans2) > 0 {
+		counts := make(map[string]float64)
+		for packed, raw := range in.trans2 {
+			cn := parseDecayed(raw, in.nowUnix)
+			if cn <= 0 {
 				continue
 			}
 			if dropSelfLoops && packed == pack(service, p) {
@@ -297,36 +800,38 @@ func main() {
 			counts[packed] = cn
 		}
 		if len(counts) > 0 {
-			applyCounts(counts)
+			applyCounts("markov_cross", counts)
 		}
 	}
 
 	// 3) OPTIONAL: prefetch attempts as weak hint
-	if allowPrefetchAttemptsInPolicy {
-		totalpStr, err := rdb.HGet(ctx, kTotalPrefetch(service), p).Result()
-		if err == nil && totalpStr != "" {
-			if totalp, err2 := strconv.ParseInt(totalpStr, 10, 64); err2 == nil && totalp > 0 {
-				if trans2p, err3 := rdb.HGetAll(ctx, kTransPrefetch(service, p)).Result(); err3 == nil && len(trans2p) > 0 {
-					for packed, cntStr := range trans2p {
-						cn, err := strconv.ParseInt(cntStr, 10, 64)
-						if err != nil || cn <= 0 {
-							continue
-						}
-						prob := (float64(cn) / float64(totalp)) * prefetchAttemptWeight
-						if prob < minProb {
-							continue
-						}
-						if cur, ok := markov[packed]; !ok || prob > cur {
-							markov[packed] = prob
-						}
-					}
+	if allowPrefetchAttemptsInPolicy && in.totalpStr != "" {
+		// totalp is decayed the same way as cn (kTotalPrefetch is written via
+		// decayIncr, same as kTransPrefetch) so this ratio tracks recent
+		// traffic instead of drifting toward zero against an ever-growing total.
+		if totalp := parseDecayed(in.totalpStr, in.nowUnix); totalp > 0 {
+			for packed, raw := range in.trans2p {
+				cn := parseDecayed(raw, in.nowUnix)
+				if cn <= 0 {
+					continue
+				}
+				prob := (cn / totalp) * prefetchAttemptWeight
+				if prob < minProb {
+					continue
+				}
+				if cur, ok := markov[packed]; !ok || prob > cur {
+					markov[packed] = prob
+					source[packed] = "prefetch"
 				}
 			}
 		}
 	}
 
 	// 4) i2v (once)
-	cands := getI2VCandidates(service, p)
+	cands := parseI2VCandidates(in.i2vRaw)
+	if policyMode == "markov_only" {
+		cands = nil
+	}
 
 	// function: filter candidate list by source-token compatibility
 	filterOut := func(items []NextPath) []NextPath {
@@ -347,220 +852,500 @@ func main() {
 		return out
 	}
 
-	// Fallback: pure markov
+	var candidates []NextPath
+
 	if len(cands) == 0 {
-		items := make([]NextPath, 0, len(markov))
+		// Fallback: pure markov
+		candidates = make([]NextPath, 0, len(markov))
 		for packed, prob := range markov {
 			svc, pp := unpack(packed)
 			if math.IsNaN(prob) || math.IsInf(prob, 0) {
 				continue
 			}
-			items = append(items, NextPath{Service: svc, Path: pp, Score: prob})
+			candidates = append(candidates, NextPath{Service: svc, Path: pp, Score: prob, Source: source[packed]})
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	} else {
+		// Hybrid scoring
+		best := map[string]float64{} // packed -> score
+		alpha := i2vAlpha
+		if policyMode == "i2v_only" {
+			alpha = 1.0
 		}
-		sort.Slice(items, func(i, j int) bool { return items[i].Score > items[j].Score })
-
-		items = filterOut(items)
 
-		if len(items) > limit {
-			items = items[:limit]
+		// score i2v cands
+		for _, it := range cands {
+			key := pack(it.Service, it.Path)
+			if dropSelfLoops && key == pack(service, p) {
+				continue
+			}
+			prob := markov[key]
+			score := alpha*it.Score + (1.0-alpha)*prob
+			if cur, ok := best[key]; !ok || score > cur {
+				best[key] = score
+			}
+			if _, ok := source[key]; !ok {
+				source[key] = "i2v"
+			}
 		}
-		if len(items) == 0 {
-			c.JSON(200, PolicyResp{NextPaths: []NextPath{}, MaxPrefetch: 0, MaxPrefetchTimeMS: 0})
-			return
+
+		// insurance: top markov edges
+		if policyMode != "i2v_only" {
+			type kv struct {
+				Key  string
+				Prob float64
+			}
+			mItems := make([]kv, 0, len(markov))
+			for k, v := range markov {
+				mItems = append(mItems, kv{Key: k, Prob: v})
+			}
+			sort.Slice(mItems, func(i, j int) bool { return mItems[i].Prob > mItems[j].Prob })
+
+			insCap := maxInt(5, limit*3)
+			if len(mItems) > insCap {
+				mItems = mItems[:insCap]
+			}
+			for _, kv := range mItems {
+				score := (1.0 - alpha) * kv.Prob
+				if cur, ok := best[kv.Key]; !ok || score > cur {
+					best[kv.Key] = score
+				}
+			}
 		}
 
-		c.JSON(200, PolicyResp{
-			NextPaths:         items,
-			MaxPrefetch:       defaultMaxPrefetch,
-			MaxPrefetchTimeMS: defaultPrefetchBudgetMS,
-		})
-		return
+		candidates = make([]NextPath, 0, len(best))
+		for packed, score := range best {
+			if math.IsNaN(score) || math.IsInf(score, 0) {
+				continue
+			}
+			svc, pp := unpack(packed)
+			candidates = append(candidates, NextPath{Service: svc, Path: pp, Score: score, Source: source[packed]})
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
 	}
 
-	// Hybrid scoring
-	best := map[string]float64{} // packed -> score
-	alpha := i2vAlpha
+	candidates = filterOut(candidates)
 
-	// score i2v cands
-	for _, it := range cands {
-		key := pack(it.Service, it.Path)
-		if dropSelfLoops && key == pack(service, p) {
-			continue
-		}
-		prob := markov[key]
-		score := alpha*it.Score + (1.0-alpha)*prob
-		if cur, ok := best[key]; !ok || score > cur {
-			best[key] = score
-		}
+	// policy-selection layer: reorder the scored candidate pool per POLICY_MODE
+	switch policyMode {
+	case "epsilon_greedy":
+		candidates = epsilonGreedyReorder(candidates)
+	case "thompson":
+		candidates = thompsonReorder(service, p, candidates)
 	}
 
-	// insurance: top markov edges
-	type kv struct {
-		Key  string
-		Prob float64
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
 	}
-	mItems := make([]kv, 0, len(markov))
-	for k, v := range markov {
-		mItems = append(mItems, kv{Key: k, Prob: v})
+	if len(candidates) == 0 {
+		return PolicyResp{NextPaths: []NextPath{}, MaxPrefetch: 0, MaxPrefetchTimeMS: 0}
 	}
-	sort.Slice(mItems, func(i, j int) bool { return mItems[i].Prob > mItems[j].Prob })
 
-	insCap := maxInt(5, limit*3)
-	if len(mItems) > insCap {
-		mItems = mItems[:insCap]
+	return PolicyResp{
+		NextPaths:         candidates,
+		MaxPrefetch:       defaultMaxPrefetch,
+		MaxPrefetchTimeMS: defaultPrefetchBudgetMS,
 	}
-	for _, kv := range mItems {
-		score := (1.0 - alpha) * kv.Prob
-		if cur, ok := best[kv.Key]; !ok || score > cur {
-			best[kv.Key] = score
-		}
+}
+
+// runPolicyBatch resolves one /policy/next_batch call in (at most) three
+// pipelined Redis round trips: the first fetches everything that doesn't
+// depend on session history (pair/cross-service/prefetch counters, i2v, and
+// the session history itself), the second fetches the n-gram hashes the
+// first round's history revealed we need, and the third writes back every
+// item's cached recommendation in one shot instead of one SET per item.
+// Results are written into out in request order.
+func runPolicyBatch(items []PolicyBatchItem, out []PolicyResp) {
+	type prepared struct {
+		service    string
+		rawPath    string
+		p          string
+		limit      int
+		skip       bool
+		fanout     int
+		histCmd    *redis.StringSliceCmd
+		transCmd   *redis.MapStringStringCmd
+		trans2Cmd  *redis.MapStringStringCmd
+		totalpCmd  *redis.StringCmd
+		trans2pCmd *redis.MapStringStringCmd
+		i2vCmd     *redis.StringCmd
+		ngramKeys  []string
+		ngramCmds  []*redis.MapStringStringCmd
 	}
 
-	out := make([]NextPath, 0, len(best))
-	for packed, score := range best {
-		if math.IsNaN(score) || math.IsInf(score, 0) {
+	prep := make([]prepared, len(items))
+
+	pipe1 := rdb.Pipeline()
+	for i, it := range items {
+		pr := prepared{rawPath: it.Path, service: it.Service}
+		pr.limit = it.Limit
+		if pr.limit == 0 {
+			pr.limit = getenvInt("POLICY_LIMIT_DEFAULT", 3)
+		}
+		if pr.limit < 0 {
+			pr.limit = 0
+		}
+		pr.p = normPath(it.Path)
+		if it.Service == "" || it.Path == "" || isNoise(pr.p) {
+			pr.skip = true
+			prep[i] = pr
 			continue
 		}
-		svc, pp := unpack(packed)
-		out = append(out, NextPath{Service: svc, Path: pp, Score: score})
-	}
-	sort.Slice(out, func(i, j int) bool { return out[i].Score > out[j].Score })
 
-	out = filterOut(out)
-
-	if len(out) > limit {
-		out = out[:limit]
-	}
-	if len(out) == 0 {
-		c.JSON(200, PolicyResp{NextPaths: []NextPath{}, MaxPrefetch: 0, MaxPrefetchTimeMS: 0})
-		return
+		if markovOrder >= 3 {
+			userKey := it.UserKey
+			if userKey == "" {
+				userKey = "anon"
+			}
+			pr.histCmd = pipe1.LRange(ctx, kSess(userKey), 0, int64(markovOrder-3))
+			pr.fanout++
+		}
+		pr.transCmd = pipe1.HGetAll(ctx, kTrans(it.Service, pr.p))
+		pr.trans2Cmd = pipe1.HGetAll(ctx, kTransAny(it.Service, pr.p))
+		pr.fanout += 2
+		if allowPrefetchAttemptsInPolicy {
+			pr.totalpCmd = pipe1.HGet(ctx, kTotalPrefetch(it.Service), pr.p)
+			pr.trans2pCmd = pipe1.HGetAll(ctx, kTransPrefetch(it.Service, pr.p))
+			pr.fanout += 2
+		}
+		pr.i2vCmd = pipe1.Get(ctx, i2vKey(it.Service, pr.p))
+		pr.fanout++
+		prep[i] = pr
 	}
 
-	c.JSON(200, PolicyResp{
-		NextPaths:         out,
-		MaxPrefetch:       defaultMaxPrefetch,
-		MaxPrefetchTimeMS: defaultPrefetchBudgetMS,
-	})
-})
-	// -------------------------
-	// Debug + misc
-	// -------------------------
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	start := time.Now()
+	_, _ = pipe1.Exec(ctx)
+	redisPipelineLatencyHist.WithLabelValues("policy_next_batch").Observe(time.Since(start).Seconds())
 
-	r.GET("/debug/policy_raw", func(c *gin.Context) {
-		service := c.Query("service")
-		path := c.Query("path")
-		if service == "" || path == "" {
-			c.JSON(400, gin.H{"error": "service and path required"})
-			return
+	pipe2 := rdb.Pipeline()
+	for i := range prep {
+		pr := &prep[i]
+		if pr.skip || pr.histCmd == nil {
+			continue
+		}
+		hist, _ := pr.histCmd.Result()
+		pr.ngramKeys = ngramContextKeys(pr.p, hist, markovOrder)
+		pr.ngramCmds = make([]*redis.MapStringStringCmd, len(pr.ngramKeys))
+		for k, ngramCtx := range pr.ngramKeys {
+			pr.ngramCmds[k] = pipe2.HGetAll(ctx, kTransN(pr.service, ngramCtx))
+			pr.fanout++
+		}
+	}
+	start2 := time.Now()
+	_, _ = pipe2.Exec(ctx)
+	redisPipelineLatencyHist.WithLabelValues("policy_next_batch_ngram").Observe(time.Since(start2).Seconds())
+
+	pipe3 := rdb.Pipeline()
+	nowUnix := time.Now().Unix()
+	for i, it := range items {
+		pr := prep[i]
+		policyRequestFanoutHist.Observe(float64(pr.fanout))
+		if pr.skip {
+			out[i] = PolicyResp{NextPaths: []NextPath{}, MaxPrefetch: 0, MaxPrefetchTimeMS: 0}
+			continue
 		}
-		p := normPath(path)
 
-		trans, _ := rdb.HGetAll(ctx, kTrans(service, p)).Result()
-		trans2, _ := rdb.HGetAll(ctx, kTransAny(service, p)).Result()
+		var totalpStr string
+		var trans2p map[string]string
+		if pr.totalpCmd != nil {
+			totalpStr, _ = pr.totalpCmd.Result()
+		}
+		if pr.trans2pCmd != nil {
+			trans2p, _ = pr.trans2pCmd.Result()
+		}
 
-		topTrans := topNHash(trans, 10)
-		topTrans2 := topNHash(trans2, 10)
+		var hashes []map[string]string
+		for _, cmd := range pr.ngramCmds {
+			h, err := cmd.Result()
+			if err != nil {
+				h = nil
+			}
+			hashes = append(hashes, h)
+		}
 
-		c.JSON(200, gin.H{
-			"p":          p,
-			"trans_keys": len(trans),
-			"trans2_keys": len(trans2),
-			"top_trans":  topTrans,
-			"top_trans2": topTrans2,
-			"i2v":        getI2VCandidates(service, p)[:minInt(10, len(getI2VCandidates(service, p)))],
+		trans, _ := pr.transCmd.Result()
+		trans2, _ := pr.trans2Cmd.Result()
+		i2vRaw, _ := pr.i2vCmd.Result()
+
+		out[i] = computePolicy(policyInputs{
+			service:    it.Service,
+			rawPath:    pr.rawPath,
+			p:          pr.p,
+			limit:      pr.limit,
+			nowUnix:    nowUnix,
+			ngramTrans: selectNgramHash(hashes),
+			trans:      trans,
+			trans2:     trans2,
+			totalpStr:  totalpStr,
+			trans2p:    trans2p,
+			i2vRaw:     i2vRaw,
 		})
-	})
 
-	// Prometheus metrics endpoint (you already scrape /metrics)
-	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
-
-	port := getenv("PORT", "8000")
-	srv := &http.Server{
-		Addr:              "0.0.0.0:" + port,
-		Handler:           r,
-		ReadHeaderTimeout: 5 * time.Second,
+		userKey := it.UserKey
+		if userKey == "" {
+			userKey = "anon"
+		}
+		queueCacheLastRecommendation(pipe3, it.Service, pr.p, userKey, out[i].NextPaths)
 	}
 
-	log.Printf("core-go up on :%s redis=%s", port, redisURL)
-	log.Fatal(srv.ListenAndServe())
+	start3 := time.Now()
+	_, _ = pipe3.Exec(ctx)
+	redisPipelineLatencyHist.WithLabelValues("policy_next_batch_cache").Observe(time.Since(start3).Seconds())
 }
 
-// =========================
-// Helpers
-// =========================
+// runIngestBatch applies a POST /ingest/events batch in two pipelined Redis
+// round trips: the first applies every decayed/plain counter update, queues
+// the last-recommendation lookups online eval needs, plus the session-history
+// reads n-gram updates need; the second consumes those lookups (eval metric
+// updates, recommendation deletes, bandit counter updates) and applies the
+// n-gram counter updates and session-buffer maintenance once history/cached
+// recommendations are known. No per-event round trip is made to Redis.
+// Sibling "event" entries for the same user_key within one batch haven't hit
+// Redis yet when the first round's session-history reads fire, so pendingSess
+// seeds each entry's n-gram context with its batch-local predecessors.
+func runIngestBatch(items []IngestBatchItem) {
+	type ngramWork struct {
+		service   string
+		userKey   string
+		f, t      string
+		histCmd   *redis.StringSliceCmd
+		priorSess []string
+	}
+	// evalWork mirrors evaluateIngestEvent's inputs/output across the two
+	// pipelined round trips: lastRecCmd is queued in pipe1, then resolved and
+	// acted on (metrics, DEL, bandit updates queued into pipe2) once pipe1
+	// has executed.
+	type evalWork struct {
+		recKey     string
+		bkey       string
+		toService  string
+		toPath     string
+		lastRecCmd *redis.StringCmd
+	}
+	ngramItems := make([]ngramWork, 0)
+	evalItems := make([]evalWork, 0)
+	// pendingSess tracks, per user_key, the from-paths already processed
+	// earlier in this same batch (newest-first) — sibling "event" entries for
+	// one user_key arrive in one /ingest/events call before any of them have
+	// been LPushed to Redis, so each entry's n-gram context must be seeded
+	// with its predecessors' paths directly instead of missing them.
+	pendingSess := make(map[string][]string)
+
+	pipe1 := rdb.Pipeline()
+	now := time.Now().Unix()
+	for _, it := range items {
+		switch it.Kind {
+		case "event":
+			ev := it.Event
+			if ev == nil {
+				continue
+			}
+			userKey := ev.UserKey
+			if userKey == "" {
+				userKey = "anon"
+			}
+			f := normPath(ev.FromPath)
+			t := normPath(ev.ToPath)
+			if isNoise(f) || isNoise(t) {
+				continue
+			}
+			recKey := kLastRec(ev.Service, f, userKey)
+			evalItems = append(evalItems, evalWork{
+				recKey:     recKey,
+				bkey:       kBandit(ev.Service, f),
+				toService:  ev.Service,
+				toPath:     t,
+				lastRecCmd: pipe1.Get(ctx, recKey),
+			})
+			pipe1.Eval(ctx, decayIncrLuaSrc, []string{kTrans(ev.Service, f)}, t, now, decayLambda)
+			pipe1.HIncrBy(ctx, kTotal(ev.Service), f, 1)
+			w := ngramWork{service: ev.Service, userKey: userKey, f: f, t: t}
+			if markovOrder >= 3 {
+				w.histCmd = pipe1.LRange(ctx, kSess(userKey), 0, int64(markovOrder-3))
+				w.priorSess = append([]string(nil), pendingSess[userKey]...)
+				pendingSess[userKey] = append([]string{f}, pendingSess[userKey]...)
+				if len(pendingSess[userKey]) > markovOrder-2 {
+					pendingSess[userKey] = pendingSess[userKey][:markovOrder-2]
+				}
+			}
+			ngramItems = append(ngramItems, w)
 
-func normPath(p string) string {
-	if p == "" {
-		return p
+		case "edge":
+			ev := it.Edge
+			if ev == nil {
+				continue
+			}
+			userKey := ev.UserKey
+			if userKey == "" {
+				userKey = "anon"
+			}
+			src := normPath(ev.SrcPath)
+			dst := normPath(ev.DstPath)
+			if isNoise(src) || isNoise(dst) {
+				continue
+			}
+			recKey := kLastRec(ev.SrcService, src, userKey)
+			evalItems = append(evalItems, evalWork{
+				recKey:     recKey,
+				bkey:       kBandit(ev.SrcService, src),
+				toService:  ev.DstService,
+				toPath:     dst,
+				lastRecCmd: pipe1.Get(ctx, recKey),
+			})
+			packed := pack(ev.DstService, dst)
+			pipe1.Eval(ctx, decayIncrLuaSrc, []string{kTransAny(ev.SrcService, src)}, packed, now, decayLambda)
+			pipe1.HIncrBy(ctx, kTotalAny(ev.SrcService), src, 1)
+
+		case "prefetch":
+			ev := it.Prefetch
+			if ev == nil {
+				continue
+			}
+			src := normPath(ev.SrcPath)
+			dst := normPath(ev.DstPath)
+			if isNoise(src) || isNoise(dst) {
+				continue
+			}
+			packed := pack(ev.DstService, dst)
+			pipe1.Eval(ctx, decayIncrLuaSrc, []string{kTransPrefetch(ev.SrcService, src)}, packed, now, decayLambda)
+			pipe1.Eval(ctx, decayIncrLuaSrc, []string{kTotalPrefetch(ev.SrcService)}, src, now, decayLambda)
+		}
 	}
-	if isNoise(p) {
-		return p
+
+	start := time.Now()
+	_, _ = pipe1.Exec(ctx)
+	redisPipelineLatencyHist.WithLabelValues("ingest_events").Observe(time.Since(start).Seconds())
+
+	pipe2 := rdb.Pipeline()
+	for _, w := range evalItems {
+		raw, err := w.lastRecCmd.Result()
+		if err != nil || raw == "" {
+			continue
+		}
+		recs, matchedRank, ok := scoreEvaluation(raw, w.toService, w.toPath)
+		if !ok {
+			continue
+		}
+		pipe2.Del(ctx, w.recKey)
+		recordEvalMetrics(recs, matchedRank)
+		if policyMode == "thompson" {
+			for i, it := range recs {
+				field := pack(it.Service, it.Path)
+				hit := i+1 == matchedRank
+				queueBanditCounterUpdate(pipe2, w.bkey, field, hit)
+			}
+		}
 	}
-	if p != "/" && strings.HasSuffix(p, "/") {
-		p = strings.TrimSuffix(p, "/")
+	for _, w := range ngramItems {
+		if w.histCmd == nil {
+			continue
+		}
+		hist, _ := w.histCmd.Result()
+		// Sibling events for this user_key processed earlier in the same
+		// batch are newer than the pre-batch Redis history but older than
+		// w.f, so they go in front of hist, same ordering LPush would have
+		// produced had each event been ingested one at a time.
+		fullHist := append(append([]string(nil), w.priorSess...), hist...)
+		for _, ngramCtx := range ngramContextKeys(w.f, fullHist, markovOrder) {
+			pipe2.HIncrBy(ctx, kTransN(w.service, ngramCtx), w.t, 1)
+		}
+		sessKey := kSess(w.userKey)
+		pipe2.LPush(ctx, sessKey, w.f)
+		pipe2.LTrim(ctx, sessKey, 0, int64(markovOrder-2))
+		pipe2.Expire(ctx, sessKey, sessTTL)
 	}
-	p = reUUID.ReplaceAllString(p, "/{uuid}$1")
-    p = reInt.ReplaceAllString(p, "/{id}$1")
-	return p
+	start2 := time.Now()
+	_, _ = pipe2.Exec(ctx)
+	redisPipelineLatencyHist.WithLabelValues("ingest_events_ngram").Observe(time.Since(start2).Seconds())
 }
 
-func isNoise(p string) bool {
-	for _, pref := range noisePrefixes {
-		if strings.HasPrefix(p, pref) {
-			return true
+// runDecayCompactor periodically scans the decayed transition hashes and evicts
+// fields whose decayed count has fallen below MIN_DECAYED_COUNT, keeping Redis
+// memory bounded under long-running deployments.
+func runDecayCompactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, pattern := range []string{"trans:*", "trans2:*", "ptrans:*", "ptot:*"} {
+			compactDecayedKeys(pattern)
 		}
 	}
-	return false
 }
 
-func i2vKey(service, path string) string {
-	return i2vPrefix + service + "::" + path
+func compactDecayedKeys(pattern string) {
+	now := time.Now().Unix()
+	var cursor uint64
+	for {
+		keys, next, err := rdb.Scan(ctx, cursor, pattern, 200).Result()
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			compactDecayedHash(key, now)
+		}
+		cursor = next
+		if cursor == 0 {
+			return
+		}
+	}
 }
 
-func parseNode(node string) (string, string, bool) {
-	parts := strings.SplitN(node, "::", 2)
-	if len(parts) != 2 {
-		return "", "", false
+func compactDecayedHash(key string, now int64) {
+	var cursor uint64
+	for {
+		fields, next, err := rdb.HScan(ctx, key, cursor, "*", 200).Result()
+		if err != nil {
+			return
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			field, raw := fields[i], fields[i+1]
+			if parseDecayed(raw, now) < minDecayedCount {
+				rdb.HDel(ctx, key, field)
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return
+		}
 	}
-	return parts[0], parts[1], true
 }
 
-func getI2VCandidates(service, path string) []NextPath {
-	raw, err := rdb.Get(ctx, i2vKey(service, path)).Result()
-	if err != nil || raw == "" {
-		return nil
-	}
-	var data []i2vItem
-	if err := json.Unmarshal([]byte(raw), &data); err != nil {
-		return nil
-	}
-	out := make([]NextPath, 0, minInt(i2vTopK, len(data)))
-	for i := 0; i < len(data) && i < i2vTopK; i++ {
-		n := data[i].Item
-		if n == "" {
-			continue
-		}
-		svc, p, ok := parseNode(n)
-		if !ok {
-			continue
+// decayIncr applies one exponentially-decayed hit to field within key, atomically
+// via decayIncrScript so the read-modify-write can't race with concurrent ingests.
+func decayIncr(key, field string) error {
+	return decayIncrScript.Run(ctx, rdb, []string{key}, field, time.Now().Unix(), decayLambda).Err()
+}
+
+// parseDecayed reads a "count|last_ts" field value and decays it forward to now.
+// Plain integer values (pre-migration data, or any field decayIncr hasn't touched
+// yet) are treated as already-current counts with no additional decay applied.
+func parseDecayed(raw string, now int64) float64 {
+	sep := strings.IndexByte(raw, '|')
+	if sep < 0 {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0
 		}
-		out = append(out, NextPath{Service: svc, Path: p, Score: data[i].Cos})
+		return v
 	}
-	return out
+	count, err1 := strconv.ParseFloat(raw[:sep], 64)
+	last, err2 := strconv.ParseInt(raw[sep+1:], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return count * math.Exp(-decayLambda*float64(now-last))
 }
 
-// Redis keys
-func kTrans(service, fromPath string) string       { return "trans:" + service + ":" + fromPath }
-func kTotal(service string) string                 { return "tot:" + service }
-func kTransAny(srcService, fromPath string) string { return "trans2:" + srcService + ":" + fromPath }
-func kTotalAny(service string) string              { return "tot2:" + service }
-func kTransPrefetch(srcService, fromPath string) string {
-	return "ptrans:" + srcService + ":" + fromPath
+func userKeyFromRequest(c *gin.Context) string {
+	uk := c.Query("user_key")
+	if uk == "" {
+		uk = c.GetHeader("X-User-Key")
+	}
+	if uk == "" {
+		uk = "anon"
+	}
+	return uk
 }
-func kTotalPrefetch(service string) string { return "ptot:" + service }
 
 func pack(svc, path string) string { return svc + "|" + path }
 func unpack(v string) (string, string) {
@@ -571,15 +1356,14 @@ func unpack(v string) (string, string) {
 	return parts[0], parts[1]
 }
 
-func topNHash(m map[string]string, n int) [][]any {
+func topNDecayedHash(m map[string]string, nowUnix int64, n int) [][]any {
 	type pair struct {
 		K string
-		V int64
+		V float64
 	}
 	arr := make([]pair, 0, len(m))
 	for k, v := range m {
-		iv, _ := strconv.ParseInt(v, 10, 64)
-		arr = append(arr, pair{K: k, V: iv})
+		arr = append(arr, pair{K: k, V: parseDecayed(v, nowUnix)})
 	}
 	sort.Slice(arr, func(i, j int) bool { return arr[i].V > arr[j].V })
 	if len(arr) > n {
@@ -592,6 +1376,243 @@ func topNHash(m map[string]string, n int) [][]any {
 	return out
 }
 
+// =========================
+// Online evaluation
+// =========================
+
+// cacheLastRecommendation stashes the ranked candidates returned for
+// (service, fromPath, userKey) so the next /ingest/event from that user can
+// be scored against them. TTL'd since a recommendation that's never acted on
+// within lastRecTTL is stale and shouldn't skew hit-rate metrics.
+func cacheLastRecommendation(service, fromPath, userKey string, items []NextPath) {
+	queueCacheLastRecommendation(rdb, service, fromPath, userKey, items)
+}
+
+// queueCacheLastRecommendation is cacheLastRecommendation's pipeline-friendly
+// core: rc is rdb for the single-request path and a pipeline for batch paths,
+// so callers that already have a round trip open can fold the SET into it
+// instead of paying for one here.
+func queueCacheLastRecommendation(rc redis.Cmdable, service, fromPath, userKey string, items []NextPath) {
+	if len(items) == 0 {
+		return
+	}
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return
+	}
+	rc.Set(ctx, kLastRec(service, fromPath, userKey), raw, lastRecTTL)
+}
+
+// scoreEvaluation parses a cached-recommendation payload and locates the
+// candidate (if any) matching the path the user actually visited next,
+// returning its 1-based rank (0 if no candidate matched). Shared between the
+// single-event and pipelined-batch evaluation paths so both attribute
+// hit@1/hit@k/MRR identically.
+func scoreEvaluation(raw, toService, toPath string) (items []NextPath, matchedRank int, ok bool) {
+	if raw == "" {
+		return nil, 0, false
+	}
+	if err := json.Unmarshal([]byte(raw), &items); err != nil || len(items) == 0 {
+		return nil, 0, false
+	}
+	for i, it := range items {
+		if it.Service == toService && it.Path == toPath {
+			return items, i + 1, true
+		}
+	}
+	return items, 0, true
+}
+
+// recordEvalMetrics attributes hit@1/hit@k/MRR and the per-evaluation total
+// to whichever subsystem contributed the matching candidate, so that
+// hitAtK[src]/evaluated[src] is a sound per-subsystem hit rate; evaluations
+// with no match are counted under the "miss" source instead of rank #1's.
+func recordEvalMetrics(items []NextPath, matchedRank int) {
+	if matchedRank == 0 {
+		evalEvaluatedTotal.WithLabelValues("miss").Inc()
+		return
+	}
+
+	src := items[matchedRank-1].Source
+	if src == "" {
+		src = "unknown"
+	}
+	evalEvaluatedTotal.WithLabelValues(src).Inc()
+	if matchedRank == 1 {
+		evalHitAtOneTotal.WithLabelValues(src).Inc()
+	}
+	if matchedRank <= evalHitK {
+		evalHitAtKTotal.WithLabelValues(src).Inc()
+	}
+	evalReciprocalRankSum.WithLabelValues(src).Add(1.0 / float64(matchedRank))
+}
+
+// evaluateIngestEvent looks up the recommendation previously cached for
+// (srcService, fromPath, userKey), compares it against the service/path the
+// user actually visited next (toService/toPath — these differ from
+// srcService/fromPath for cross-service navigations), and records
+// hit@1/hit@k/MRR attributed to whichever subsystem contributed the matching
+// candidate. In thompson policy mode it also updates the per-candidate
+// bandit hit/miss counters used by thompsonReorder. The cached
+// recommendation is consumed (deleted) either way.
+func evaluateIngestEvent(srcService, fromPath, userKey, toService, toPath string) {
+	key := kLastRec(srcService, fromPath, userKey)
+	raw, err := rdb.Get(ctx, key).Result()
+	if err != nil || raw == "" {
+		return
+	}
+	rdb.Del(ctx, key)
+
+	items, matchedRank, ok := scoreEvaluation(raw, toService, toPath)
+	if !ok {
+		return
+	}
+	recordEvalMetrics(items, matchedRank)
+
+	if policyMode == "thompson" {
+		bkey := kBandit(srcService, fromPath)
+		for i, it := range items {
+			field := pack(it.Service, it.Path)
+			hit := i+1 == matchedRank
+			updateBanditCounter(bkey, field, hit)
+		}
+	}
+}
+
+// updateBanditCounter applies one hit or miss observation to the "hits|misses"
+// value stored at hash field, via banditIncrScript so the read-modify-write
+// can't race with a concurrent update to the same field.
+func updateBanditCounter(hashKey, field string, hit bool) {
+	banditIncrScript.Run(ctx, rdb, []string{hashKey}, field, banditHitArg(hit))
+}
+
+// queueBanditCounterUpdate is updateBanditCounter's pipeline-friendly
+// counterpart: pipelines can't retry a NOSCRIPT reply mid-exec, so it sends
+// banditIncrLuaSrc with EVAL on every call instead of going through the
+// SHA-cached banditIncrScript.
+func queueBanditCounterUpdate(pipe redis.Pipeliner, hashKey, field string, hit bool) {
+	pipe.Eval(ctx, banditIncrLuaSrc, []string{hashKey}, field, banditHitArg(hit))
+}
+
+func banditHitArg(hit bool) string {
+	if hit {
+		return "1"
+	}
+	return "0"
+}
+
+// =========================
+// Bandit / POLICY_MODE reordering
+// =========================
+
+// epsilonGreedyReorder exploits the existing score order most of the time,
+// but with probability epsilonGreedyEpsilon promotes a random non-top
+// candidate to the front so the bandit keeps gathering data on the rest.
+func epsilonGreedyReorder(candidates []NextPath) []NextPath {
+	if len(candidates) < 2 || rand.Float64() >= epsilonGreedyEpsilon {
+		return candidates
+	}
+	i := 1 + rand.Intn(len(candidates)-1)
+	out := make([]NextPath, 0, len(candidates))
+	out = append(out, candidates[i])
+	out = append(out, candidates[:i]...)
+	out = append(out, candidates[i+1:]...)
+	return out
+}
+
+// thompsonReorder draws one sample per candidate from its Beta(alpha+hits,
+// beta+misses) posterior (prior from banditPriorAlpha/banditPriorBeta) and
+// ranks by sampled value, so candidates with little data still get picked
+// often enough to learn whether they're good.
+func thompsonReorder(service, fromPath string, candidates []NextPath) []NextPath {
+	if len(candidates) < 2 {
+		return candidates
+	}
+	bkey := kBandit(service, fromPath)
+	fields := make([]string, len(candidates))
+	for i, c := range candidates {
+		fields[i] = pack(c.Service, c.Path)
+	}
+	raws, err := rdb.HMGet(ctx, bkey, fields...).Result()
+	if err != nil {
+		raws = make([]any, len(candidates))
+	}
+
+	type sampled struct {
+		idx   int
+		value float64
+	}
+	samples := make([]sampled, len(candidates))
+	for i := range candidates {
+		alpha, beta := banditPriorAlpha, banditPriorBeta
+		if s, ok := raws[i].(string); ok && s != "" {
+			if sep := strings.IndexByte(s, '|'); sep >= 0 {
+				if hits, err := strconv.ParseFloat(s[:sep], 64); err == nil {
+					alpha += hits
+				}
+				if misses, err := strconv.ParseFloat(s[sep+1:], 64); err == nil {
+					beta += misses
+				}
+			}
+		}
+		samples[i] = sampled{idx: i, value: sampleBeta(alpha, beta)}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].value > samples[j].value })
+
+	out := make([]NextPath, len(candidates))
+	for i, s := range samples {
+		out[i] = candidates[s.idx]
+	}
+	return out
+}
+
+// sampleGamma draws from Gamma(shape, 1) via Marsaglia-Tsang, the standard
+// rejection sampler; used to build sampleBeta since no stats package is
+// vendored here. shape must be > 0.
+func sampleGamma(shape float64) float64 {
+	if shape < 1 {
+		// Gamma(shape+1) * U^(1/shape) has the Gamma(shape) distribution.
+		u := rand.Float64()
+		if u <= 0 {
+			u = 1e-12
+		}
+		return sampleGamma(shape+1) * math.Pow(u, 1.0/shape)
+	}
+	d := shape - 1.0/3.0
+	c := 1.0 / math.Sqrt(9.0*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1.0 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if u < 1.0-0.0331*x*x*x*x {
+			return d * v
+		}
+		if math.Log(u) < 0.5*x*x+d*(1.0-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
+
+// sampleBeta draws from Beta(alpha, beta) via the standard two-Gamma ratio.
+func sampleBeta(alpha, beta float64) float64 {
+	if alpha <= 0 {
+		alpha = 1e-6
+	}
+	if beta <= 0 {
+		beta = 1e-6
+	}
+	x := sampleGamma(alpha)
+	y := sampleGamma(beta)
+	if x+y <= 0 {
+		return 0.5
+	}
+	return x / (x + y)
+}
+
 // env helpers
 func getenv(k, def string) string {
 	v := strings.TrimSpace(os.Getenv(k))